@@ -0,0 +1,273 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/internal/docstore/driver"
+	"gocloud.dev/internal/docstore/flowctl"
+)
+
+// RevisionField is the name of the document field used for document revision
+// information, to implement optimistic locking. See the Revisions section of
+// the package documentation for more information.
+const RevisionField = "DocstoreRevision"
+
+// A Document is a set of field-value pairs, represented as a map or a
+// pointer to a struct. A document must have one or more key fields that
+// uniquely identify it among all the documents in its collection.
+type Document = interface{}
+
+// FieldPath is a dot-separated sequence of UTF-8 field names, like "a.b.c",
+// used to refer to a (possibly nested) field of a document.
+type FieldPath string
+
+func (fp FieldPath) split() []string {
+	return strings.Split(string(fp), ".")
+}
+
+// Mods is a map from field paths to modifications. A nil value means
+// "delete this field"; any other value means "set this field to this value".
+// It is used in Collection.Update and ActionList.Update.
+type Mods map[FieldPath]interface{}
+
+// A Collection represents a set of documents. It is safe for use by multiple
+// goroutines.
+type Collection struct {
+	driver      driver.Collection
+	byteMonitor *flowctl.Monitor
+	opMonitor   *flowctl.Monitor
+}
+
+// NewCollection creates a Collection from a driver.Collection. It is intended
+// for use by provider implementations.
+func NewCollection(d driver.Collection) *Collection {
+	return &Collection{driver: d}
+}
+
+// WithRateLimit caps the sustained throughput of ActionLists run against c to
+// at most bytesPerSec bytes and opsPerSec actions per second. A zero value
+// for either argument leaves that dimension unrestricted. WithRateLimit
+// returns c so it can be chained with NewCollection.
+func (c *Collection) WithRateLimit(bytesPerSec, opsPerSec int64) *Collection {
+	c.byteMonitor = flowctl.NewMonitor(bytesPerSec)
+	c.opMonitor = flowctl.NewMonitor(opsPerSec)
+	return c
+}
+
+// Actions returns an ActionList that can be used to perform a sequence of
+// actions on the collection's documents.
+func (c *Collection) Actions() *ActionList {
+	return &ActionList{coll: c}
+}
+
+// Create adds doc to the collection. It is an error if a document with the
+// same key already exists.
+func (c *Collection) Create(ctx context.Context, doc Document) error {
+	_, err := c.Actions().Create(doc).Do(ctx)
+	return err
+}
+
+// Put adds or replaces doc in the collection.
+func (c *Collection) Put(ctx context.Context, doc Document) error {
+	_, err := c.Actions().Put(doc).Do(ctx)
+	return err
+}
+
+// Replace replaces doc in the collection. It is an error if no document with
+// doc's key exists.
+func (c *Collection) Replace(ctx context.Context, doc Document) error {
+	_, err := c.Actions().Replace(doc).Do(ctx)
+	return err
+}
+
+// Get retrieves a document into doc, which must contain the collection's key
+// fields. If fps is non-empty, only those fields are populated in doc.
+func (c *Collection) Get(ctx context.Context, doc Document, fps ...FieldPath) error {
+	_, err := c.Actions().Get(doc, fps...).Do(ctx)
+	return err
+}
+
+// Delete removes doc from the collection. doc must contain the collection's
+// key fields, and may also contain a revision, in which case Delete fails if
+// the document has since been changed.
+func (c *Collection) Delete(ctx context.Context, doc Document) error {
+	_, err := c.Actions().Delete(doc).Do(ctx)
+	return err
+}
+
+// Update atomically applies mods to the document described by doc, which must
+// contain the collection's key fields.
+func (c *Collection) Update(ctx context.Context, doc Document, mods Mods) error {
+	_, err := c.Actions().Update(doc, mods).Do(ctx)
+	return err
+}
+
+// An ActionKind describes the type of operation an Action performs.
+type ActionKind int
+
+// The supported ActionKinds.
+const (
+	ActionCreate ActionKind = iota
+	ActionReplace
+	ActionPut
+	ActionGet
+	ActionDelete
+	ActionUpdate
+)
+
+// An Action is a single operation on a single document, to be executed as
+// part of an ActionList.
+type Action struct {
+	kind       ActionKind
+	doc        Document
+	fieldPaths []FieldPath
+	mods       Mods
+}
+
+// An ActionList is a sequence of actions to be run, in order, on a
+// collection. Use Collection.Actions to create one.
+type ActionList struct {
+	coll    *Collection
+	actions []*Action
+	atomic  bool
+}
+
+// Atomic marks the ActionList as requiring all-or-nothing semantics: either
+// every action in the list succeeds, or (on error) none of them take effect.
+// Do returns an error if the collection's driver can't provide that
+// guarantee.
+func (l *ActionList) Atomic() *ActionList {
+	l.atomic = true
+	return l
+}
+
+// Create adds an action that creates a new document to the list.
+func (l *ActionList) Create(doc Document) *ActionList {
+	return l.add(&Action{kind: ActionCreate, doc: doc})
+}
+
+// Put adds an action that adds or replaces a document to the list.
+func (l *ActionList) Put(doc Document) *ActionList {
+	return l.add(&Action{kind: ActionPut, doc: doc})
+}
+
+// Replace adds an action that replaces a document to the list.
+func (l *ActionList) Replace(doc Document) *ActionList {
+	return l.add(&Action{kind: ActionReplace, doc: doc})
+}
+
+// Get adds an action that retrieves a document to the list. If fps is
+// non-empty, only those fields are populated in doc.
+func (l *ActionList) Get(doc Document, fps ...FieldPath) *ActionList {
+	return l.add(&Action{kind: ActionGet, doc: doc, fieldPaths: fps})
+}
+
+// Delete adds an action that deletes a document to the list.
+func (l *ActionList) Delete(doc Document) *ActionList {
+	return l.add(&Action{kind: ActionDelete, doc: doc})
+}
+
+// Update adds an action that applies mods to a document to the list.
+func (l *ActionList) Update(doc Document, mods Mods) *ActionList {
+	return l.add(&Action{kind: ActionUpdate, doc: doc, mods: mods})
+}
+
+func (l *ActionList) add(a *Action) *ActionList {
+	l.actions = append(l.actions, a)
+	return l
+}
+
+// Do executes the action list's actions in order. If they all succeed, it
+// returns the number of actions and a nil error. If any fails, it returns 0
+// and an error describing the failure; it does not report how many actions
+// ran before the failure.
+func (l *ActionList) Do(ctx context.Context) (int, error) {
+	das, err := l.toDriverActions()
+	if err != nil {
+		return 0, err
+	}
+	if l.coll.opMonitor != nil {
+		l.coll.opMonitor.Limit(int64(len(das)))
+	}
+	if l.coll.byteMonitor != nil {
+		l.coll.byteMonitor.Limit(approxBytes(das))
+	}
+	if l.atomic {
+		if tc, ok := l.coll.driver.(driver.Transactional); ok {
+			if err := tc.RunInTransaction(ctx, das); err != nil {
+				return 0, l.coll.wrapError(err)
+			}
+			return len(das), nil
+		}
+	}
+	if err := l.coll.driver.RunActions(ctx, das, &driver.RunActionsOptions{Atomic: l.atomic}); err != nil {
+		return 0, l.coll.wrapError(err)
+	}
+	return len(das), nil
+}
+
+// driverError wraps an error returned by the driver, attaching the
+// gcerrors.ErrorCode the driver reports for it so that gcerrors.Code(err)
+// classifies the error correctly.
+type driverError struct {
+	err  error
+	code gcerrors.ErrorCode
+}
+
+func (e *driverError) Error() string                 { return e.err.Error() }
+func (e *driverError) Unwrap() error                 { return e.err }
+func (e *driverError) ErrorCode() gcerrors.ErrorCode { return e.code }
+
+func (c *Collection) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &driverError{err: err, code: c.driver.ErrorCode(err)}
+}
+
+// approxBytes estimates the wire size of a batch of actions, for the
+// purposes of rate limiting. It need not be exact.
+func approxBytes(das []*driver.Action) int64 {
+	var n int64
+	for _, da := range das {
+		n += int64(len(fmt.Sprintf("%v", da.Doc)))
+	}
+	return n
+}
+
+func (l *ActionList) toDriverActions() ([]*driver.Action, error) {
+	var das []*driver.Action
+	for _, a := range l.actions {
+		da := &driver.Action{Kind: driver.ActionKind(a.kind), Doc: a.doc}
+		if len(a.fieldPaths) > 0 {
+			for _, fp := range a.fieldPaths {
+				da.FieldPaths = append(da.FieldPaths, fp.split())
+			}
+		}
+		if a.mods != nil {
+			da.Mods = map[string]interface{}{}
+			for fp, v := range a.mods {
+				da.Mods[string(fp)] = v
+			}
+		}
+		das = append(das, da)
+	}
+	return das, nil
+}
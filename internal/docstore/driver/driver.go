@@ -0,0 +1,192 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package driver defines interfaces to be implemented by docstore drivers,
+// which will be used by the docstore package to interact with the underlying
+// services. Application code should use package docstore.
+package driver // import "gocloud.dev/internal/docstore/driver"
+
+import (
+	"context"
+
+	"gocloud.dev/gcerrors"
+)
+
+// A Document is a set of field-value pairs. One or more fields, called the key
+// fields, must uniquely identify the document among all others present in the
+// document's collection. Each driver implementation specifies the type of
+// Go value that represents a Document: usually a map or a pointer to a
+// struct.
+type Document interface{}
+
+// ActionKind identifies the type of action performed by an Action.
+type ActionKind int
+
+// Action kinds supported by all drivers.
+const (
+	Create ActionKind = iota
+	Replace
+	Put
+	Get
+	Delete
+	Update
+)
+
+// An Action describes a single operation performed on a document.
+type Action struct {
+	Kind ActionKind
+	Doc  Document
+	// FieldPaths holds the field paths to retrieve, for Get actions. A nil
+	// slice means retrieve all fields.
+	FieldPaths [][]string
+	// Mods holds the field modifications to make, for Update actions, keyed
+	// by dotted field path. A nil value means the field should be deleted.
+	Mods map[string]interface{}
+}
+
+// RunActionsOptions describes how a batch of actions should be executed.
+type RunActionsOptions struct {
+	// Atomic, if true, requires that either all of the actions succeed or
+	// none of them do: if any action fails, the driver must undo the effects
+	// of any actions in the batch that already ran.
+	Atomic bool
+}
+
+// Transactional is an optional interface that a driver.Collection may
+// implement if it can run a batch of actions as a true all-or-nothing
+// transaction. When a Collection's driver implements Transactional, an
+// ActionList run with Atomic set calls RunInTransaction instead of
+// RunActions, so drivers that have native multi-document transactions don't
+// have to fake them through RunActionsOptions.Atomic.
+type Transactional interface {
+	// RunInTransaction executes actions as a single transaction: either all
+	// of them take effect, or (on error) none of them do.
+	RunInTransaction(ctx context.Context, actions []*Action) error
+}
+
+// Collection is the interface that must be implemented by a docstore driver.
+type Collection interface {
+	// Key returns the document's primary key, or nil if the document doesn't
+	// have one.
+	Key(doc Document) (interface{}, error)
+
+	// RunActions executes a sequence of actions. It returns an error when one
+	// of them fails. If opts.Atomic is true, RunActions must either apply all
+	// of the actions or none of them.
+	RunActions(ctx context.Context, actions []*Action, opts *RunActionsOptions) error
+
+	// RunGetQuery executes a Query and returns an iterator over the results.
+	RunGetQuery(ctx context.Context, q *Query) (DocumentIterator, error)
+
+	// RevisionField returns the name of the field used to hold revisions.
+	RevisionField() string
+
+	// As converts i to provider-specific types.
+	As(i interface{}) bool
+
+	// ErrorCode translates a provider-specific error into a gcerrors.ErrorCode.
+	ErrorCode(err error) gcerrors.ErrorCode
+
+	// Close cleans up any resources used by the Collection.
+	Close() error
+}
+
+// A Query defines a query over a collection, to be pushed down to the driver.
+// The portable layer does no filtering, ordering or limiting of its own: it
+// passes the Query to RunGetQuery and returns the driver's results as they
+// are.
+type Query struct {
+	// FieldPaths holds the fields to retrieve. A nil slice means all fields.
+	FieldPaths [][]string
+
+	// Filters holds the filters to apply, ANDed together.
+	Filters []Filter
+
+	// OrderByField, if non-empty, is the field to order the results by.
+	OrderByField string
+
+	// OrderAscending indicates the direction of OrderByField; it is only
+	// meaningful when OrderByField is non-empty.
+	OrderAscending bool
+
+	// Limit, if greater than zero, limits the number of results.
+	Limit int
+}
+
+// A Filter is one predicate in a Query, of the form "FieldPath Op Value".
+type Filter struct {
+	FieldPath []string    // the field to filter on
+	Op        string      // one of "=", "<", "<=", ">", ">="
+	Value     interface{} // the value to compare against
+}
+
+// WatchableCollection is an optional interface implemented by drivers whose
+// backing service can stream document changes, natively or by tailing an
+// internal log.
+type WatchableCollection interface {
+	// Watch returns a ChangeStream of changes to documents matching q. If
+	// resumeToken is non-nil, the stream picks up after the position it
+	// encodes -- as previously returned on a Change -- instead of starting
+	// from the current moment.
+	Watch(ctx context.Context, q *Query, resumeToken []byte) (ChangeStream, error)
+}
+
+// ChangeKind identifies the kind of document modification a Change
+// describes.
+type ChangeKind int
+
+// The supported ChangeKinds.
+const (
+	ChangeCreate ChangeKind = iota
+	ChangeUpdate
+	ChangeDelete
+)
+
+// A Change describes a single modification observed by a ChangeStream.
+type Change struct {
+	Kind ChangeKind
+	// Doc is the document's state after the change; nil for ChangeDelete.
+	Doc Document
+	// OldDoc is the document's state before the change, if the driver can
+	// provide it; nil otherwise, and always nil for ChangeCreate.
+	OldDoc Document
+	// Revision is the document's revision as of this change.
+	Revision interface{}
+	// ResumeToken encodes this change's position in the stream. Passing it
+	// to a later call to Watch resumes the stream immediately after this
+	// change.
+	ResumeToken []byte
+}
+
+// ChangeStream is returned by WatchableCollection.Watch.
+type ChangeStream interface {
+	// Next blocks until the next change is available, returning it, or
+	// until ctx is done or the stream is closed.
+	Next(ctx context.Context) (*Change, error)
+
+	// Close terminates the stream, freeing any resources it holds.
+	Close() error
+}
+
+// DocumentIterator iterates over documents returned from a query.
+type DocumentIterator interface {
+	// Next populates doc with the next document in the iteration and
+	// advances the iterator. It returns io.EOF if there are no more
+	// documents.
+	Next(ctx context.Context, doc Document) error
+
+	// Stop terminates the iterator, freeing any resources it holds. Calling
+	// Next after Stop returns io.EOF.
+	Stop()
+}
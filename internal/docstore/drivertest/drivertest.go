@@ -18,7 +18,11 @@ package drivertest // import "gocloud.dev/internal/docstore/drivertest"
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"math/rand"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -38,6 +42,26 @@ type Harness interface {
 
 	// Close closes resources used by the harness.
 	Close()
+
+	// UnsupportedQueryOps reports the query operators and orderings that
+	// this driver's Collection can't push down. testQuery uses this to skip
+	// subtests that the driver has no way to satisfy, the same way
+	// CodecTester.UnsupportedTypes lets a codec opt out of type coverage.
+	// A nil or empty result means the driver supports every operator and
+	// ordering that the conformance tests exercise.
+	UnsupportedQueryOps() []string
+
+	// SupportsAtomic reports whether the driver can run an ActionList with
+	// all-or-nothing semantics, either via driver.Transactional or by
+	// honoring RunActionsOptions.Atomic in RunActions. testTransaction skips
+	// itself when this returns false, the same way a false UnsupportedTypes
+	// entry lets a codec opt out of a type it doesn't support.
+	SupportsAtomic() bool
+
+	// SupportsWatch reports whether the driver implements
+	// driver.WatchableCollection. testWatch skips itself when this returns
+	// false, since not every provider has a native change feed.
+	SupportsWatch() bool
 }
 
 // HarnessMaker describes functions that construct a harness for running tests.
@@ -82,6 +106,53 @@ func RunConformanceTests(t *testing.T, newHarness HarnessMaker, ct CodecTester)
 	t.Run("Update", func(t *testing.T) { withCollection(t, newHarness, testUpdate) })
 	t.Run("Data", func(t *testing.T) { withCollection(t, newHarness, testData) })
 	t.Run("Codec", func(t *testing.T) { testCodec(t, ct) })
+	t.Run("CodecFuzz", func(t *testing.T) { testCodecFuzz(t, ct) })
+	t.Run("Query", func(t *testing.T) {
+		ctx := context.Background()
+		h, err := newHarness(ctx, t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		dc, err := h.MakeCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testQuery(t, ds.NewCollection(dc), h.UnsupportedQueryOps())
+	})
+	t.Run("RateLimit", func(t *testing.T) { withCollection(t, newHarness, testRateLimit) })
+	t.Run("Transaction", func(t *testing.T) {
+		ctx := context.Background()
+		h, err := newHarness(ctx, t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		if !h.SupportsAtomic() {
+			t.Skip("driver does not support atomic ActionLists")
+		}
+		dc, err := h.MakeCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testTransaction(t, ds.NewCollection(dc))
+	})
+	t.Run("Watch", func(t *testing.T) {
+		ctx := context.Background()
+		h, err := newHarness(ctx, t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		if !h.SupportsWatch() {
+			t.Skip("driver does not support Watch")
+		}
+		dc, err := h.MakeCollection(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testWatch(t, ds.NewCollection(dc))
+	})
 }
 
 const KeyField = "_id"
@@ -370,6 +441,308 @@ func testData(t *testing.T, coll *ds.Collection) {
 
 }
 
+// testRateLimit submits a burst of Puts through a rate-limited collection and
+// checks that it took at least a third as long as the configured ceiling
+// implies.
+// It only asserts a lower bound: scheduling jitter can always make a run
+// slower, never faster, than the configured rate allows.
+func testRateLimit(t *testing.T, coll *ds.Collection) {
+	ctx := context.Background()
+	const (
+		bytesPerSec = 20000
+		numPuts     = 10
+		docSize     = 4000 // bytes, approximately
+	)
+	coll.WithRateLimit(bytesPerSec, 0)
+	doc := docmap{KeyField: "testRateLimit", "s": strings.Repeat("x", docSize)}
+	start := time.Now()
+	for i := 0; i < numPuts; i++ {
+		if err := coll.Put(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	// The Monitor's moving average ramps up gradually, so a short burst like
+	// this one won't be throttled down to the configured rate exactly; just
+	// check that it's meaningfully slower than an unthrottled burst would be.
+	want := time.Duration(float64(numPuts*docSize)/bytesPerSec*float64(time.Second)) / 3
+	if elapsed < want {
+		t.Errorf("burst of %d puts completed in %v, wanted at least %v given a %d bytes/sec limit", numPuts, elapsed, want, bytesPerSec)
+	}
+}
+
+// testTransaction checks that ActionList.Atomic gives all-or-nothing
+// semantics, and that concurrent atomic updates to the same document never
+// lose a write.
+func testTransaction(t *testing.T, coll *ds.Collection) {
+	ctx := context.Background()
+
+	t.Run("AbortLeavesNoSideEffects", func(t *testing.T) {
+		doc1 := docmap{KeyField: "testTransaction1", "x": 1}
+		doc2 := docmap{KeyField: "testTransaction2", "x": 1}
+		// doc2 doesn't exist yet, so this stale-revision Update will fail
+		// (with FailedPrecondition or NotFound) partway through the list.
+		doc2[ds.RevisionField] = "bogus-revision"
+		defer func() {
+			_, _ = coll.Actions().Delete(docmap{KeyField: doc1[KeyField]}).Delete(docmap{KeyField: doc2[KeyField]}).Do(ctx)
+		}()
+
+		_, err := coll.Actions().Atomic().Create(doc1).Update(doc2, ds.Mods{"x": 2}).Do(ctx)
+		if err == nil {
+			t.Fatal("got nil, want error from the Update with a stale revision")
+		}
+		if err := coll.Get(ctx, docmap{KeyField: doc1[KeyField]}); err == nil {
+			t.Error("doc1 exists after an aborted atomic ActionList; Atomic should have rolled it back")
+		}
+	})
+
+	t.Run("ConcurrentIncrements", func(t *testing.T) {
+		const numGoroutines = 10
+		counter := docmap{KeyField: "testTransactionCounter", "n": int64(0)}
+		if err := coll.Put(ctx, counter); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = coll.Delete(ctx, docmap{KeyField: counter[KeyField]}) }()
+
+		var wg sync.WaitGroup
+		for i := 0; i < numGoroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					got := docmap{KeyField: counter[KeyField]}
+					if err := coll.Get(ctx, got); err != nil {
+						t.Error(err)
+						return
+					}
+					n := got["n"].(int64)
+					_, err := coll.Actions().Atomic().Update(got, ds.Mods{"n": n + 1}).Do(ctx)
+					if err == nil {
+						return
+					}
+					if gcerrors.Code(err) != gcerrors.FailedPrecondition {
+						t.Error(err)
+						return
+					}
+					// Someone else updated the counter first; retry.
+				}
+			}()
+		}
+		wg.Wait()
+
+		final := docmap{KeyField: counter[KeyField]}
+		if err := coll.Get(ctx, final); err != nil {
+			t.Fatal(err)
+		}
+		if got := final["n"]; got != int64(numGoroutines) {
+			t.Errorf("got final counter %v, want %d", got, numGoroutines)
+		}
+	})
+}
+
+// watchNextTimeout bounds each call to ChangeIterator.Next in testWatch, so
+// a driver with a stalled or buggy change feed fails the test instead of
+// hanging the run indefinitely.
+const watchNextTimeout = 30 * time.Second
+
+// testWatch scripts a Put, Update and Delete of the same document and
+// checks that Watch reports them, in order, with the expected kinds. It
+// then closes the iterator and reopens one from the last seen resume token,
+// checking that the stream picks up where it left off instead of replaying
+// or dropping events.
+func testWatch(t *testing.T, coll *ds.Collection) {
+	ctx := context.Background()
+	const key = "testWatch"
+	defer func() { _ = coll.Delete(ctx, docmap{KeyField: key}) }()
+
+	watchQuery := func() *ds.Query { return coll.Query().Where(ds.FieldPath(KeyField), "=", key) }
+
+	next := func(it *ds.ChangeIterator) (*ds.ChangeEvent, error) {
+		ctx, cancel := context.WithTimeout(ctx, watchNextTimeout)
+		defer cancel()
+		return it.Next(ctx)
+	}
+
+	iter, err := coll.Watch(ctx, watchQuery())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := coll.Put(ctx, docmap{KeyField: key, "n": int64(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Update(ctx, docmap{KeyField: key}, ds.Mods{"n": int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.Delete(ctx, docmap{KeyField: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	wantKinds := []ds.ChangeKind{ds.Create, ds.Update, ds.Delete}
+	var gotKinds []ds.ChangeKind
+	for range wantKinds {
+		ev, err := next(iter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotKinds = append(gotKinds, ev.Kind)
+	}
+	if !reflect.DeepEqual(gotKinds, wantKinds) {
+		t.Errorf("got event kinds %v, want %v", gotKinds, wantKinds)
+	}
+	token := iter.ResumeToken()
+	iter.Close()
+
+	// Close mid-stream and resume from the last seen token: a further
+	// change should be reported exactly once, not replayed or dropped. The
+	// first Put's Create event (n == 0) also has Kind == Create, so check
+	// the document content too -- a driver that ignores resumeToken and
+	// replays from the start would otherwise pass this check by accident.
+	if err := coll.Put(ctx, docmap{KeyField: key, "n": int64(2)}); err != nil {
+		t.Fatal(err)
+	}
+	iter2, err := coll.WatchFrom(ctx, watchQuery(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter2.Close()
+	ev, err := next(iter2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Kind != ds.Create {
+		t.Errorf("after resume: got kind %v, want Create", ev.Kind)
+	}
+	doc, ok := ev.Doc.(docmap)
+	if !ok {
+		t.Fatalf("after resume: event Doc has type %T, want docmap", ev.Doc)
+	}
+	if doc["n"] != int64(2) {
+		t.Errorf("after resume: got n=%v, want 2 (a replayed event would show n=0)", doc["n"])
+	}
+}
+
+// Query operators and orderings that a driver may declare, via
+// Harness.UnsupportedQueryOps, that it cannot push down. testQuery skips the
+// corresponding subtest rather than failing the driver for a limitation it
+// has already advertised.
+const (
+	unsupportedLess       = "<"
+	unsupportedLessEq     = "<="
+	unsupportedGreater    = ">"
+	unsupportedGreaterEq  = ">="
+	unsupportedOrderBy    = "orderBy"
+	numQueryTestDocuments = 200
+)
+
+func testQuery(t *testing.T, coll *ds.Collection, unsupportedOps []string) {
+	ctx := context.Background()
+	unsupported := map[string]bool{}
+	for _, op := range unsupportedOps {
+		unsupported[op] = true
+	}
+
+	// Populate the collection with enough documents that a driver has to
+	// exercise its pagination code path, then clean them all up afterward.
+	var docs []docmap
+	for i := 0; i < numQueryTestDocuments; i++ {
+		docs = append(docs, docmap{KeyField: fmt.Sprintf("testQuery%d", i), "n": int64(i), "group": int64(i % 10)})
+	}
+	al := coll.Actions()
+	for _, d := range docs {
+		al = al.Put(d)
+	}
+	if _, err := al.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		al := coll.Actions()
+		for _, d := range docs {
+			al = al.Delete(docmap{KeyField: d[KeyField]})
+		}
+		_, _ = al.Do(ctx)
+	}()
+
+	drain := func(iter *ds.DocumentIterator) []docmap {
+		t.Helper()
+		var got []docmap
+		for {
+			m := docmap{}
+			err := iter.Next(ctx, m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, m)
+		}
+		iter.Stop()
+		return got
+	}
+
+	t.Run("Equality", func(t *testing.T) {
+		iter := coll.Query().Where("group", "=", int64(3)).Get(ctx)
+		got := drain(iter)
+		if len(got) != numQueryTestDocuments/10 {
+			t.Errorf("got %d documents, want %d", len(got), numQueryTestDocuments/10)
+		}
+		for _, g := range got {
+			if g["group"] != int64(3) {
+				t.Errorf("got group %v, want 3", g["group"])
+			}
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		if unsupported[unsupportedGreaterEq] || unsupported[unsupportedLess] {
+			t.Skip("driver does not support range predicates")
+		}
+		iter := coll.Query().Where("n", ">=", int64(10)).Where("n", "<", int64(20)).Get(ctx)
+		got := drain(iter)
+		if len(got) != 10 {
+			t.Errorf("got %d documents, want 10", len(got))
+		}
+	})
+
+	t.Run("OrderByAndLimit", func(t *testing.T) {
+		if unsupported[unsupportedOrderBy] {
+			t.Skip("driver does not support ordering")
+		}
+		iter := coll.Query().OrderBy("n", ds.Descending).Limit(5).Get(ctx)
+		got := drain(iter)
+		if len(got) != 5 {
+			t.Fatalf("got %d documents, want 5", len(got))
+		}
+		for i, want := 0, int64(numQueryTestDocuments-1); i < len(got); i, want = i+1, want-1 {
+			if got[i]["n"] != want {
+				t.Errorf("position %d: got n=%v, want %v", i, got[i]["n"], want)
+			}
+		}
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		if unsupported[unsupportedOrderBy] || unsupported[unsupportedGreater] {
+			t.Skip("driver does not support the ordering/range combination pagination needs")
+		}
+		const pageSize = 25
+		var all []docmap
+		var last int64 = -1
+		for {
+			iter := coll.Query().Where("n", ">", last).OrderBy("n", ds.Ascending).Limit(pageSize).Get(ctx)
+			page := drain(iter)
+			if len(page) == 0 {
+				break
+			}
+			all = append(all, page...)
+			last = page[len(page)-1]["n"].(int64)
+		}
+		if len(all) != numQueryTestDocuments {
+			t.Errorf("got %d documents across all pages, want %d", len(all), numQueryTestDocuments)
+		}
+	})
+}
+
 func testCodec(t *testing.T, ct CodecTester) {
 	if ct == nil {
 		t.Skip("no CodecTester")
@@ -528,6 +901,251 @@ func testCodec(t *testing.T, ct CodecTester) {
 	}
 }
 
+// codecFuzzSeed is the seed for testCodecFuzz's random value generator. It
+// can be overridden with SetCodecFuzzSeedForTesting to replay a failure seen
+// in CI.
+var codecFuzzSeed int64 = 1
+
+// SetCodecFuzzSeedForTesting fixes the seed used by testCodecFuzz, so a
+// failure observed in one run -- and the minimal repro value it reports --
+// can be reproduced locally. Call it before RunConformanceTests.
+func SetCodecFuzzSeedForTesting(seed int64) {
+	codecFuzzSeed = seed
+}
+
+const numFuzzIterations = 30
+
+// fuzzNested is the type of fuzzStruct's Nest field, to exercise codecs'
+// handling of struct-valued fields.
+type fuzzNested struct {
+	X int
+	Y string
+}
+
+// fuzzStruct covers the docstore-supported type universe: pointers, nested
+// structs, maps with string keys, slices, fixed-size arrays, and time.Time.
+type fuzzStruct struct {
+	N    *int
+	I    int
+	U    uint
+	C    complex128
+	St   string
+	B    bool
+	L    []int
+	A    [3]int
+	M    map[string]int
+	P    *string
+	T    time.Time
+	Nest fuzzNested
+}
+
+// testCodecFuzz generates random fuzzStruct values with a seeded, replayable
+// generator and checks that all four encode/decode round trips preserve
+// them, the same way testCodec does for its hand-written values. Types that
+// ct declares unsupported are left at their zero value, and times are
+// generated with millisecond precision only when NanosecondTimes is
+// unsupported, so drivers aren't penalized for a limitation they've already
+// advertised.
+func testCodecFuzz(t *testing.T, ct CodecTester) {
+	if ct == nil {
+		t.Skip("no CodecTester")
+	}
+	unsupported := map[UnsupportedType]bool{}
+	for _, u := range ct.UnsupportedTypes() {
+		unsupported[u] = true
+	}
+	r := rand.New(rand.NewSource(codecFuzzSeed))
+
+	roundTrips := []struct {
+		name   string
+		encode func(interface{}) (interface{}, error)
+		decode func(value, dest interface{}) error
+	}{
+		{"Docstore->Docstore", ct.DocstoreEncode, ct.DocstoreDecode},
+		{"Docstore->Native", ct.DocstoreEncode, ct.NativeDecode},
+		{"Native->Docstore", ct.NativeEncode, ct.DocstoreDecode},
+		{"Native->Native", ct.NativeEncode, ct.NativeDecode},
+	}
+
+	for i := 0; i < numFuzzIterations; i++ {
+		// Alternate nanosecond- and millisecond-precision times across
+		// iterations, as testCodec's hand-written cases do.
+		v := fuzzValue(r, unsupported, i%2 == 0)
+		for _, rt := range roundTrips {
+			fails := func(x *fuzzStruct) bool {
+				enc, err := rt.encode(x)
+				if err != nil {
+					return true
+				}
+				got := &fuzzStruct{}
+				if err := rt.decode(enc, got); err != nil {
+					return true
+				}
+				return cmp.Diff(x, got) != ""
+			}
+			if !fails(v) {
+				continue
+			}
+			min := shrinkFuzz(v, fails)
+			enc, encErr := rt.encode(min)
+			if encErr != nil {
+				t.Errorf("seed %d, iteration %d, %s: round trip failed to encode.\nminimal repro: %+v\nerror: %+v",
+					codecFuzzSeed, i, rt.name, min, encErr)
+				continue
+			}
+			got := &fuzzStruct{}
+			if decErr := rt.decode(enc, got); decErr != nil {
+				t.Errorf("seed %d, iteration %d, %s: round trip failed to decode.\nminimal repro: %+v\nerror: %+v",
+					codecFuzzSeed, i, rt.name, min, decErr)
+				continue
+			}
+			t.Errorf("seed %d, iteration %d, %s: round trip mismatch.\nminimal repro: %+v\ndiff (-want +got): %s",
+				codecFuzzSeed, i, rt.name, min, cmp.Diff(min, got))
+		}
+	}
+}
+
+// fuzzValue returns a randomly populated fuzzStruct, using r for all
+// randomness so that the same seed always produces the same sequence of
+// values. Fields corresponding to Uint, Complex and Arrays in unsupported are
+// left zero; if NanosecondTimes is in unsupported, T has millisecond
+// precision.
+func fuzzValue(r *rand.Rand, unsupported map[UnsupportedType]bool, nanos bool) *fuzzStruct {
+	v := &fuzzStruct{}
+	if r.Intn(2) == 0 {
+		n := r.Intn(1000) - 500
+		v.N = &n
+	}
+	v.I = r.Intn(2000) - 1000
+	if !unsupported[Uint] {
+		v.U = uint(r.Intn(1000))
+	}
+	if !unsupported[Complex] {
+		v.C = complex(float64(r.Intn(100)), float64(r.Intn(100)))
+	}
+	v.St = fuzzString(r, r.Intn(10))
+	v.B = r.Intn(2) == 0
+	for n := r.Intn(5); n > 0; n-- {
+		v.L = append(v.L, r.Intn(1000))
+	}
+	if !unsupported[Arrays] {
+		for i := range v.A {
+			v.A[i] = r.Intn(100)
+		}
+	}
+	if n := r.Intn(4); n > 0 {
+		v.M = map[string]int{}
+		for ; n > 0; n-- {
+			v.M[fuzzString(r, 3)] = r.Intn(100)
+		}
+	}
+	if r.Intn(2) == 0 {
+		s := fuzzString(r, r.Intn(8))
+		v.P = &s
+	}
+	base := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration(r.Intn(1e9)) * time.Second).
+		Add(time.Duration(r.Intn(1000)) * time.Millisecond)
+	if nanos && !unsupported[NanosecondTimes] {
+		base = base.Add(time.Duration(1 + r.Intn(1e6)))
+	}
+	v.T = base
+	v.Nest = fuzzNested{X: r.Intn(100), Y: fuzzString(r, 4)}
+	return v
+}
+
+const fuzzLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func fuzzString(r *rand.Rand, n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = fuzzLetters[r.Intn(len(fuzzLetters))]
+	}
+	return string(b)
+}
+
+// shrinkFuzz repeatedly tries to simplify v -- by zeroing a field or
+// shortening a slice or map -- as long as the simplified value still fails
+// the given predicate, so that a failing fuzz case ends up as small as
+// possible before being reported.
+func shrinkFuzz(v *fuzzStruct, fails func(*fuzzStruct) bool) *fuzzStruct {
+	cur := v
+	for {
+		next := cur
+		for _, cand := range fuzzShrinkCandidates(cur) {
+			if fails(cand) {
+				next = cand
+				break
+			}
+		}
+		if next == cur {
+			return cur
+		}
+		cur = next
+	}
+}
+
+// fuzzShrinkCandidates returns simplified copies of v, each removing or
+// zeroing one field, element or map entry.
+func fuzzShrinkCandidates(v *fuzzStruct) []*fuzzStruct {
+	var cs []*fuzzStruct
+	add := func(c fuzzStruct) { cs = append(cs, &c) }
+	if v.N != nil {
+		c := *v
+		c.N = nil
+		add(c)
+	}
+	if v.P != nil {
+		c := *v
+		c.P = nil
+		add(c)
+	}
+	if v.I != 0 {
+		c := *v
+		c.I = 0
+		add(c)
+	}
+	if v.U != 0 {
+		c := *v
+		c.U = 0
+		add(c)
+	}
+	if v.C != 0 {
+		c := *v
+		c.C = 0
+		add(c)
+	}
+	if v.St != "" {
+		c := *v
+		c.St = ""
+		add(c)
+	}
+	if len(v.L) > 0 {
+		c := *v
+		c.L = v.L[:len(v.L)-1]
+		add(c)
+	}
+	if len(v.M) > 0 {
+		c := *v
+		c.M = map[string]int{}
+		first := true
+		for k, val := range v.M {
+			if first {
+				first = false
+				continue
+			}
+			c.M[k] = val
+		}
+		add(c)
+	}
+	if v.Nest != (fuzzNested{}) {
+		c := *v
+		c.Nest = fuzzNested{}
+		add(c)
+	}
+	return cs
+}
+
 // Call when running tests that will be replayed.
 // Each seed value will result in UniqueString producing the same sequence of values.
 func MakeUniqueStringDeterministicForTesting(seed int64) {
@@ -0,0 +1,102 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flowctl supports rate-limiting the consumption of a countable
+// resource -- bytes transferred, operations performed, or anything else --
+// to a configured sustained rate.
+package flowctl // import "gocloud.dev/internal/docstore/flowctl"
+
+import (
+	"sync"
+	"time"
+)
+
+// window is the time constant of the exponential moving average maintained
+// by a Monitor: roughly, how far back in time a sample still influences the
+// current rate estimate.
+const window = 100 * time.Millisecond
+
+// A Monitor tracks the rate at which a resource is consumed and blocks
+// callers via Limit so that the sustained rate stays at or below a
+// configured ceiling. It is meant to guard a single resource (for example,
+// bytes written); use two Monitors if you need to cap both bytes/sec and
+// ops/sec independently.
+//
+// Monitor is safe for concurrent use by multiple goroutines.
+type Monitor struct {
+	mu    sync.Mutex
+	limit int64               // ceiling, in units/sec; zero or negative means unlimited
+	now   func() time.Time    // clock, overridden in tests for deterministic timing
+	sleep func(time.Duration) // delay, overridden in tests so they don't block on real time
+
+	last time.Time // time of the most recent sample; zero until the first call to Limit
+	ema  float64   // exponential moving average of the rate, in units/sec
+}
+
+// NewMonitor returns a Monitor that limits the sustained rate of whatever the
+// caller is counting to limit units per second. A limit of zero (or
+// negative) means unlimited; Limit then always returns immediately.
+func NewMonitor(limit int64) *Monitor {
+	return &Monitor{limit: limit, now: time.Now, sleep: time.Sleep}
+}
+
+// Rate returns the Monitor's current exponential moving average of the
+// observed rate, in units per second. It is intended for tests and
+// diagnostics.
+func (m *Monitor) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ema
+}
+
+// Limit records that the caller is about to consume want units, sleeping
+// first if doing so immediately would push the Monitor's moving average
+// above its configured limit. It returns the number of units the caller may
+// proceed with, which is always want: Limit enforces the ceiling by
+// delaying the caller rather than by shrinking the request.
+func (m *Monitor) Limit(want int64) int64 {
+	if want <= 0 || m.limit <= 0 {
+		return want
+	}
+	m.mu.Lock()
+	now := m.now() // time.Now is backed by a monotonic clock reading
+	var elapsed time.Duration
+	if m.last.IsZero() {
+		// No history yet: assume this request arrived over one window, so a
+		// single oversized burst is throttled immediately instead of being
+		// let through for lack of a baseline.
+		elapsed = window
+	} else if elapsed = now.Sub(m.last); elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	instRate := float64(want) / elapsed.Seconds()
+	alpha := elapsed.Seconds() / window.Seconds()
+	if alpha > 1 {
+		alpha = 1
+	}
+	m.ema += alpha * (instRate - m.ema)
+	m.last = now
+	over := m.ema - float64(m.limit)
+	m.mu.Unlock()
+
+	if over > 0 {
+		// Sleep long enough that, once this request has drained at the
+		// configured rate, the moving average will have decayed back down
+		// to the limit.
+		if sleep := time.Duration(over / float64(m.limit) * float64(window)); sleep > 0 {
+			m.sleep(sleep)
+		}
+	}
+	return want
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowctl
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestZeroLimitIsUnlimited(t *testing.T) {
+	m := NewMonitor(0)
+	if got := m.Limit(1 << 30); got != 1<<30 {
+		t.Errorf("got %d, want 1<<30", got)
+	}
+}
+
+func TestLimitReturnsWhatWasAsked(t *testing.T) {
+	m := NewMonitor(1000)
+	for _, want := range []int64{0, 1, 100, 1000} {
+		if got := m.Limit(want); got != want {
+			t.Errorf("Limit(%d) = %d, want %d", want, got, want)
+		}
+	}
+}
+
+// TestEMAConvergesToLimit feeds a Monitor a fake, monotonically advancing
+// clock and a steady stream of samples at exactly the configured limit,
+// and checks that the moving average settles on that limit rather than
+// drifting or oscillating. The clock and sleep are both faked so the test
+// is deterministic and doesn't block on real time.
+func TestEMAConvergesToLimit(t *testing.T) {
+	const limit = 1000
+	const step = window / 10 // alpha = 0.1 per sample
+	want := int64(limit * step.Seconds())
+
+	m := NewMonitor(limit)
+	clock := time.Unix(0, 0)
+	m.now = func() time.Time { return clock }
+	m.sleep = func(time.Duration) {} // don't actually wait; only the EMA is under test
+
+	for i := 0; i < 100; i++ {
+		clock = clock.Add(step)
+		m.Limit(want)
+	}
+	if rate := m.Rate(); math.Abs(rate-limit) > limit*0.01 {
+		t.Errorf("after 100 samples at the limit, Rate() = %v, want within 1%% of %v", rate, float64(limit))
+	}
+}
+
+// TestLimitSleepsToEnforceCeiling checks that a burst that pushes the EMA
+// over the configured limit makes Limit sleep for the duration the formula
+// in Limit computes, using a fake clock and a fake sleep so the test runs
+// instantly and deterministically.
+func TestLimitSleepsToEnforceCeiling(t *testing.T) {
+	const limit = 100
+	m := NewMonitor(limit)
+	m.now = func() time.Time { return time.Unix(1000, 0) }
+	var slept time.Duration
+	m.sleep = func(d time.Duration) { slept = d }
+
+	// The first sample assumes it arrived over one window, so instRate ==
+	// want/window.Seconds() and alpha == 1: the EMA jumps straight to
+	// instRate. want=20 over a 100ms window gives instRate=200, 100 over
+	// the limit, which Limit should translate into a 100ms sleep.
+	if got := m.Limit(20); got != 20 {
+		t.Errorf("Limit returned %d, want 20", got)
+	}
+	if want := 100 * time.Millisecond; slept != want {
+		t.Errorf("slept %v, want %v", slept, want)
+	}
+}
+
+func TestConcurrentCallersDontRace(t *testing.T) {
+	m := NewMonitor(1e9) // high enough that no goroutine actually sleeps
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Limit(100)
+		}()
+	}
+	wg.Wait()
+	if m.Rate() < 0 {
+		t.Errorf("got negative rate %v", m.Rate())
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"context"
+	"io"
+
+	"gocloud.dev/internal/docstore/driver"
+)
+
+// A Query builds up a query to run against the collection. Queries are
+// immutable: each method returns a new Query built from the receiver, so
+// they can be assembled incrementally and safely shared.
+//
+//	iter := coll.Query().Where("Size", ">", 10).OrderBy("Size", docstore.Descending).Limit(5).Get(ctx)
+type Query struct {
+	coll         *Collection
+	filters      []filter
+	orderByField FieldPath
+	desc         bool
+	hasOrderBy   bool
+	limit        int
+}
+
+// Direction specifies the order in which OrderBy sorts results.
+type Direction string
+
+// The two supported sort directions.
+const (
+	Ascending  Direction = "asc"
+	Descending Direction = "desc"
+)
+
+type filter struct {
+	fp  FieldPath
+	op  string
+	val interface{}
+}
+
+// Query returns a new Query on the collection.
+func (c *Collection) Query() *Query {
+	return &Query{coll: c}
+}
+
+// Where adds a filter on the value of fp to the query. op is one of "=",
+// "<", "<=", ">" or ">=". The query will only return documents for which
+// fp op value is true.
+func (q *Query) Where(fp FieldPath, op string, value interface{}) *Query {
+	q2 := q.clone()
+	q2.filters = append(q2.filters, filter{fp: fp, op: op, val: value})
+	return q2
+}
+
+// OrderBy specifies that the results should be sorted by fp, in the given
+// direction. Only one OrderBy may be specified; later calls replace earlier
+// ones.
+func (q *Query) OrderBy(fp FieldPath, dir Direction) *Query {
+	q2 := q.clone()
+	q2.orderByField = fp
+	q2.desc = dir == Descending
+	q2.hasOrderBy = true
+	return q2
+}
+
+// Limit caps the number of documents returned by the query.
+func (q *Query) Limit(n int) *Query {
+	q2 := q.clone()
+	q2.limit = n
+	return q2
+}
+
+func (q *Query) clone() *Query {
+	c := *q
+	c.filters = append([]filter(nil), q.filters...)
+	return &c
+}
+
+// Get runs the query and returns an iterator over the results. If fps is
+// non-empty, only those fields are populated in the returned documents.
+func (q *Query) Get(ctx context.Context, fps ...FieldPath) *DocumentIterator {
+	dq := q.toDriverQuery(fps)
+	it, err := q.coll.driver.RunGetQuery(ctx, dq)
+	if err != nil {
+		return &DocumentIterator{coll: q.coll, err: q.coll.wrapError(err)}
+	}
+	return &DocumentIterator{coll: q.coll, iter: it}
+}
+
+// toDriverQuery builds the driver.Query that the filters, ordering and limit
+// accumulated on q translate to. It is shared by Get and Watch so the two
+// APIs push the same predicate down to the driver.
+func (q *Query) toDriverQuery(fps []FieldPath) *driver.Query {
+	dq := &driver.Query{Limit: q.limit}
+	for _, fp := range fps {
+		dq.FieldPaths = append(dq.FieldPaths, fp.split())
+	}
+	for _, f := range q.filters {
+		dq.Filters = append(dq.Filters, driver.Filter{FieldPath: f.fp.split(), Op: f.op, Value: f.val})
+	}
+	if q.hasOrderBy {
+		dq.OrderByField = string(q.orderByField)
+		dq.OrderAscending = !q.desc
+	}
+	return dq
+}
+
+// A DocumentIterator iterates over documents returned from a query. Call
+// Next repeatedly to obtain each document, until Next returns io.EOF.
+type DocumentIterator struct {
+	coll *Collection
+	iter driver.DocumentIterator
+	err  error
+}
+
+// Next populates doc with the next document in the query result, and
+// advances the iterator. It returns io.EOF when there are no more
+// documents.
+func (it *DocumentIterator) Next(ctx context.Context, doc Document) error {
+	if it.err != nil {
+		return it.err
+	}
+	err := it.iter.Next(ctx, doc)
+	if err == io.EOF {
+		return err
+	}
+	return it.coll.wrapError(err)
+}
+
+// Stop terminates the iterator, freeing up resources. Stop must be called
+// when done with the iterator, typically in a defer statement.
+func (it *DocumentIterator) Stop() {
+	if it.iter != nil {
+		it.iter.Stop()
+	}
+}
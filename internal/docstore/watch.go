@@ -0,0 +1,113 @@
+// Copyright 2019 The Go Cloud Development Kit Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package docstore
+
+import (
+	"context"
+	"errors"
+
+	"gocloud.dev/internal/docstore/driver"
+)
+
+// ChangeKind identifies the kind of document modification a ChangeEvent
+// describes.
+type ChangeKind int
+
+// The supported ChangeKinds.
+const (
+	Create ChangeKind = iota
+	Update
+	Delete
+)
+
+// A ChangeEvent describes a single modification observed by a Watch.
+type ChangeEvent struct {
+	// Kind is the kind of modification that occurred.
+	Kind ChangeKind
+	// Doc is the document's state after the change; nil for a Delete event.
+	Doc Document
+	// OldDoc is the document's state before the change, if the driver can
+	// provide it; nil otherwise, and always nil for a Create event.
+	OldDoc Document
+	// Revision is the document's revision as of this event.
+	Revision interface{}
+}
+
+// Watch returns a ChangeIterator that yields a ChangeEvent for every
+// document matching q that is created, updated or deleted from this moment
+// on. The collection's driver must implement driver.WatchableCollection;
+// Watch returns an error otherwise.
+func (c *Collection) Watch(ctx context.Context, q *Query) (*ChangeIterator, error) {
+	return c.watch(ctx, q, nil)
+}
+
+// WatchFrom resumes a Watch from resumeToken, a value previously obtained
+// from ChangeIterator.ResumeToken, so a caller that closed or lost its
+// iterator doesn't miss or replay events.
+func (c *Collection) WatchFrom(ctx context.Context, q *Query, resumeToken []byte) (*ChangeIterator, error) {
+	return c.watch(ctx, q, resumeToken)
+}
+
+func (c *Collection) watch(ctx context.Context, q *Query, resumeToken []byte) (*ChangeIterator, error) {
+	wc, ok := c.driver.(driver.WatchableCollection)
+	if !ok {
+		return nil, errors.New("docstore: collection's driver does not support Watch")
+	}
+	if q == nil {
+		q = &Query{coll: c}
+	}
+	cs, err := wc.Watch(ctx, q.toDriverQuery(nil), resumeToken)
+	if err != nil {
+		return nil, c.wrapError(err)
+	}
+	return &ChangeIterator{coll: c, stream: cs}, nil
+}
+
+// A ChangeIterator iterates over the change events produced by a Watch.
+// Call Next repeatedly to obtain each event.
+type ChangeIterator struct {
+	coll   *Collection
+	stream driver.ChangeStream
+	last   []byte
+}
+
+// Next blocks until the next ChangeEvent is available, ctx is done, or the
+// iterator is closed.
+func (it *ChangeIterator) Next(ctx context.Context) (*ChangeEvent, error) {
+	c, err := it.stream.Next(ctx)
+	if err != nil {
+		return nil, it.coll.wrapError(err)
+	}
+	it.last = c.ResumeToken
+	return &ChangeEvent{
+		Kind:     ChangeKind(c.Kind),
+		Doc:      c.Doc,
+		OldDoc:   c.OldDoc,
+		Revision: c.Revision,
+	}, nil
+}
+
+// ResumeToken returns a token encoding the position of the most recent
+// ChangeEvent returned by Next. Pass it to WatchFrom to resume the stream
+// after closing this iterator.
+func (it *ChangeIterator) ResumeToken() []byte {
+	return it.last
+}
+
+// Close terminates the iterator, freeing any resources it holds. Close must
+// be called when done with the iterator, typically in a defer statement.
+func (it *ChangeIterator) Close() error {
+	return it.stream.Close()
+}